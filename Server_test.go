@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// newTestServer connects to the Postgres instance pointed at by BALANCE_TEST_DSN and returns a
+// fresh Server on top of it. Tests that need a real database skip themselves when it isn't set.
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+
+	dsn := os.Getenv("BALANCE_TEST_DSN")
+	if dsn == "" {
+		t.Skip("BALANCE_TEST_DSN not set, skipping test against Postgres")
+	}
+
+	db, err := sqlx.Connect("postgres", dsn)
+	if err != nil {
+		t.Fatalf("can't connect to postgres: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return NewServer(db)
+}
+
+// isRetriableTxError reports whether err is a Postgres deadlock (40P01) or serialization failure
+// (40001) that withTx should have retried away before it ever reached the caller.
+func isRetriableTxError(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	return pqErr.Code == "40P01" || pqErr.Code == "40001"
+}
+
+// TestServer_CrissCrossTransfersDeadlock runs 1->2 and 2->1 transfers concurrently and checks
+// that withTx's retries keep any deadlock or serialization failure between the two directions
+// from reaching the caller, and that the combined balance of both accounts is conserved.
+func TestServer_CrissCrossTransfersDeadlock(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+
+	const (
+		account1  = UserId(1)
+		account2  = UserId(2)
+		n         = 20
+		amount    = 10
+		seedFunds = 1000
+	)
+
+	if err := server.add(ctx, account1, seedFunds); err != nil {
+		t.Fatalf("can't seed account 1: %s", err)
+	}
+	if err := server.add(ctx, account2, seedFunds); err != nil {
+		t.Fatalf("can't seed account 2: %s", err)
+	}
+
+	errs := make(chan error, 2*n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs <- server.transfer(ctx, account1, account2, amount)
+		}()
+		go func() {
+			defer wg.Done()
+			errs <- server.transfer(ctx, account2, account1, amount)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err == nil {
+			continue
+		}
+		if isRetriableTxError(err) {
+			t.Fatalf("transfer returned a deadlock/serialization error instead of retrying: %s", err)
+		}
+		if err.Error() != "balance < amount" {
+			t.Errorf("unexpected transfer error: %s", err)
+		}
+	}
+
+	balance1, err := server.balance(ctx, account1)
+	if err != nil {
+		t.Fatalf("can't read balance for account 1: %s", err)
+	}
+	balance2, err := server.balance(ctx, account2)
+	if err != nil {
+		t.Fatalf("can't read balance for account 2: %s", err)
+	}
+	if balance1+balance2 != 2*seedFunds {
+		t.Fatalf("expected combined balance to stay at %d, got %d", 2*seedFunds, balance1+balance2)
+	}
+}
+
+// TestServer_FanInFanOutTransfers runs concurrent transfers around a ring of 5 accounts
+// (1->2, 2->3, ..., 5->1), so every account both sends and receives, and checks that no goroutine
+// observes a deadlock or serialization error and that the total balance across all accounts is
+// conserved.
+func TestServer_FanInFanOutTransfers(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+
+	const (
+		numAccounts  = 5
+		numTransfers = 50
+		amount       = 10
+		seedFunds    = 1000
+	)
+
+	for i := 1; i <= numAccounts; i++ {
+		if err := server.add(ctx, UserId(i), seedFunds); err != nil {
+			t.Fatalf("can't seed account %d: %s", i, err)
+		}
+	}
+
+	errs := make(chan error, numTransfers)
+	var wg sync.WaitGroup
+	for i := 0; i < numTransfers; i++ {
+		from := UserId(i%numAccounts + 1)
+		to := UserId((i+1)%numAccounts + 1)
+		wg.Add(1)
+		go func(from, to UserId) {
+			defer wg.Done()
+			errs <- server.transfer(ctx, from, to, amount)
+		}(from, to)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err == nil {
+			continue
+		}
+		if isRetriableTxError(err) {
+			t.Fatalf("transfer returned a deadlock/serialization error instead of retrying: %s", err)
+		}
+		if err.Error() != "balance < amount" {
+			t.Errorf("unexpected transfer error: %s", err)
+		}
+	}
+
+	var total int64
+	for i := 1; i <= numAccounts; i++ {
+		b, err := server.balance(ctx, UserId(i))
+		if err != nil {
+			t.Fatalf("can't read balance for account %d: %s", i, err)
+		}
+		total += b
+	}
+	if want := int64(numAccounts * seedFunds); total != want {
+		t.Fatalf("expected total balance to be conserved at %d, got %d", want, total)
+	}
+}
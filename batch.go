@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+// TransferLeg is one movement of amount between two accounts inside a TransferBatch. From or To
+// may be nil to express a withdrawal or a deposit respectively, mirroring add/withdraw/transfer.
+type TransferLeg struct {
+	From   *UserId
+	To     *UserId
+	Amount int64
+}
+
+// TransferBatch commits every leg inside a single transaction, letting a caller split a payment
+// across N recipients (or collect it from N payers) atomically. Affected accounts are locked in
+// ascending UserId order, the same order for every caller, so two overlapping batches can never
+// deadlock on each other the way two transfers touching the same accounts in opposite order can.
+//
+// There is no batch-level zero-sum check here: a TransferLeg carries both its From and To, so a
+// leg that moves money between two accounts already balances itself by construction, and a batch
+// of such legs has nothing left over for a "do the legs net to zero" check to ever reject. A real
+// double-entry balance check needs single-sided legs (one account, one signed amount each,
+// expressing a debit or a credit), which is a different TransferLeg shape than this one.
+func (s *Server) TransferBatch(ctx context.Context, legs []TransferLeg) error {
+	if len(legs) == 0 {
+		return errors.New("transfer batch must have at least one leg")
+	}
+
+	accounts := legAccounts(legs)
+	ordered := make([]UserId, 0, len(accounts))
+	for id := range accounts {
+		ordered = append(ordered, id)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i] < ordered[j] })
+
+	return s.withTx(ctx, sql.LevelRepeatableRead, func(tx *sqlx.Tx) error {
+		balances := make(map[UserId]int64, len(ordered))
+		for _, id := range ordered {
+			balance, _, err := getBalanceForUpdate(ctx, tx, id)
+			if err != nil {
+				return fmt.Errorf("can't get balance for user %d: %w", id, err)
+			}
+			balances[id] = balance
+		}
+
+		for _, leg := range legs {
+			if leg.From != nil && balances[*leg.From] < leg.Amount {
+				return fmt.Errorf("balance < amount for user %d", *leg.From)
+			}
+
+			var txID uuid.UUID
+			err := tx.QueryRowxContext(ctx, `
+				INSERT INTO transactions (id, user_from, user_to, amount, status, created_at)
+					VALUES (gen_random_uuid(), $1, $2, $3, $4, NOW())
+				RETURNING id
+			`, leg.From, leg.To, leg.Amount, statusPending).Scan(&txID)
+			if err != nil {
+				return fmt.Errorf("can't run query: %w", err)
+			}
+			if err := setTransactionStatus(ctx, tx, txID, statusCompleted); err != nil {
+				return err
+			}
+
+			if leg.From != nil {
+				balances[*leg.From] -= leg.Amount
+			}
+			if leg.To != nil {
+				balances[*leg.To] += leg.Amount
+			}
+		}
+
+		// Deliberately not calling updateBalance here: each leg's own transaction_num is only
+		// known after its insert, and the accounts snapshot must be tagged with it exactly, or a
+		// later getBalance would re-sum these same legs on top of an already-updated sum and
+		// double-count them. Leave the snapshot stale; withdraw/transfer/balance's lazy
+		// getBalance + updateBalance already recompute it correctly from the transactions log on
+		// the next read.
+		return nil
+	})
+}
+
+// legAccounts collects the set of accounts touched by legs, which TransferBatch locks in
+// ascending order before reading or changing any of their balances.
+func legAccounts(legs []TransferLeg) map[UserId]struct{} {
+	accounts := make(map[UserId]struct{})
+	for _, leg := range legs {
+		if leg.From != nil {
+			accounts[*leg.From] = struct{}{}
+		}
+		if leg.To != nil {
+			accounts[*leg.To] = struct{}{}
+		}
+	}
+	return accounts
+}
+
+// getBalanceForUpdate is getBalance with the accounts row locked FOR UPDATE, so that concurrent
+// batches touching the same user block on each other instead of racing on the same balance. A
+// user with no snapshot row yet has nothing for FOR UPDATE to lock, which would silently defeat
+// the ordered-locking guarantee TransferBatch relies on for a fresh account, so the snapshot row
+// is first upserted into existence before it's selected FOR UPDATE. On conflict the upsert
+// rewrites the existing row with its own values rather than doing nothing: under REPEATABLE READ
+// a row another transaction only locked can still be read through a snapshot that predates that
+// transaction's legs, whereas a row it wrote makes the waiting transaction fail with a
+// serialization error, which withTx retries on a fresh snapshot.
+func getBalanceForUpdate(ctx context.Context, tx *sqlx.Tx, userId UserId) (balance int64, transactionNum int64, err error) {
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO accounts (user_id, transaction_num, sum) VALUES ($1, 0, 0)
+		ON CONFLICT (user_id) DO UPDATE SET transaction_num = accounts.transaction_num
+	`, userId); err != nil {
+		return 0, 0, fmt.Errorf("can't ensure account snapshot row: %w", err)
+	}
+
+	rowsAccountBalance := tx.QueryRowxContext(
+		ctx,
+		`SELECT transaction_num, sum FROM accounts WHERE user_id = $1 FOR UPDATE`,
+		userId)
+	accountBalance := &RawAccountBalance{}
+	err = rowsAccountBalance.StructScan(accountBalance)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, 0, fmt.Errorf("can't scan accountBalance: %w", err)
+	}
+
+	rowsTransactionsBalance := tx.QueryRowxContext(ctx, `
+		SELECT COALESCE(SUM(s), 0) balance, COALESCE(MAX(tn), $2) transaction_num FROM (
+			SELECT SUM(amount) s, MAX(transaction_num) tn FROM transactions
+				WHERE user_to = $1 AND transaction_num > $2 AND status = 'completed'
+			UNION
+			SELECT -1*SUM(amount) s, MAX(transaction_num) tn FROM transactions
+				WHERE user_from = $1 AND transaction_num > $2 AND status = 'completed'
+		) sums
+	`, userId, accountBalance.TransactionNum)
+	transactionBalance := &RawTransactionBalance{}
+	err = rowsTransactionsBalance.StructScan(transactionBalance)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, 0, fmt.Errorf("can't scan transactionBalance: %w", err)
+	}
+
+	return accountBalance.Sum + transactionBalance.Balance, transactionBalance.TransactionNum, nil
+}
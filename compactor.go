@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Compactor periodically folds each user's append-only transactions log back into the accounts
+// snapshot cache, so getBalance's two SUM subqueries keep scanning only the transactions written
+// since the last snapshot instead of the user's whole history.
+type Compactor struct {
+	server   *Server
+	interval time.Duration
+	// threshold is how many uncompacted transactions a user must accumulate before Run bothers
+	// recomputing and storing their snapshot.
+	threshold int64
+
+	usersCompacted uint64 // Prometheus-style counter: users folded into accounts since creation.
+	rowsCollapsed  uint64 // Prometheus-style counter: transactions rows each snapshot now covers.
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+// NewCompactor returns a Compactor that, once Run, recomputes the snapshot for any user with
+// more than threshold transactions newer than their current snapshot, every interval.
+func NewCompactor(server *Server, interval time.Duration, threshold int64) *Compactor {
+	return &Compactor{
+		server:    server,
+		interval:  interval,
+		threshold: threshold,
+		stop:      make(chan struct{}),
+	}
+}
+
+// Run ticks every c.interval until ctx is cancelled or Stop is called, compacting on each tick.
+// It's meant to be started in its own goroutine.
+func (c *Compactor) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			if err := c.compactOnce(ctx); err != nil {
+				fmt.Printf("compactor: %s\n", err)
+			}
+		}
+	}
+}
+
+// Stop ends Run's loop. Safe to call more than once.
+func (c *Compactor) Stop() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+// UsersCompacted returns how many users have had their snapshot recomputed since this Compactor
+// was created.
+func (c *Compactor) UsersCompacted() uint64 {
+	return atomic.LoadUint64(&c.usersCompacted)
+}
+
+// RowsCollapsed returns how many transactions rows have been folded into a snapshot since this
+// Compactor was created.
+func (c *Compactor) RowsCollapsed() uint64 {
+	return atomic.LoadUint64(&c.rowsCollapsed)
+}
+
+// compactionCandidate is a user whose transactions outrun their accounts snapshot by more than
+// threshold rows.
+type compactionCandidate struct {
+	UserId UserId `db:"uid"`
+	Count  int64  `db:"cnt"`
+}
+
+func (c *Compactor) compactOnce(ctx context.Context) error {
+	candidates, err := c.findCandidates(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, candidate := range candidates {
+		err := c.server.withTx(ctx, sql.LevelSerializable, func(tx *sqlx.Tx) error {
+			balance, transactionNum, err := getBalance(ctx, tx, candidate.UserId)
+			if err != nil {
+				return fmt.Errorf("can't get balance: %w", err)
+			}
+			return updateBalance(ctx, candidate.UserId, balance, transactionNum, tx)
+		})
+		if err != nil {
+			return fmt.Errorf("can't compact user %d: %w", candidate.UserId, err)
+		}
+
+		atomic.AddUint64(&c.usersCompacted, 1)
+		atomic.AddUint64(&c.rowsCollapsed, uint64(candidate.Count))
+	}
+
+	return nil
+}
+
+// findCandidates lists every user with more than c.threshold completed transactions newer than
+// their current accounts snapshot (transaction_num defaults to 0 for a user with no snapshot yet).
+func (c *Compactor) findCandidates(ctx context.Context) ([]compactionCandidate, error) {
+	var candidates []compactionCandidate
+	err := c.server.db.SelectContext(ctx, &candidates, `
+		SELECT uid, COUNT(*) AS cnt FROM (
+			SELECT user_to AS uid, transaction_num FROM transactions
+				WHERE user_to IS NOT NULL AND status = 'completed'
+			UNION ALL
+			SELECT user_from AS uid, transaction_num FROM transactions
+				WHERE user_from IS NOT NULL AND status = 'completed'
+		) t
+		LEFT JOIN accounts a ON a.user_id = t.uid
+		WHERE t.transaction_num > COALESCE(a.transaction_num, 0)
+		GROUP BY uid
+		HAVING COUNT(*) > $1
+	`, c.threshold)
+	if err != nil {
+		return nil, fmt.Errorf("can't find compaction candidates: %w", err)
+	}
+	return candidates, nil
+}
+
+// PurgeCompacted is an offline maintenance operation: it deletes transactions rows older than
+// olderThan that are already reflected in every account they touch, keeping the append-only log
+// bounded. A transfer's row is only deleted once both the sender's and the recipient's snapshot
+// cover it; a deposit or withdrawal only needs the one account it touches.
+func (c *Compactor) PurgeCompacted(ctx context.Context, olderThan time.Duration) error {
+	cutoff := time.Now().Add(-olderThan)
+
+	_, err := c.server.db.ExecContext(ctx, `
+		DELETE FROM transactions t
+		WHERE t.status = 'completed'
+			AND t.created_at < $1
+			AND (t.user_to IS NULL OR EXISTS (
+				SELECT 1 FROM accounts a WHERE a.user_id = t.user_to AND a.transaction_num >= t.transaction_num
+			))
+			AND (t.user_from IS NULL OR EXISTS (
+				SELECT 1 FROM accounts a WHERE a.user_id = t.user_from AND a.transaction_num >= t.transaction_num
+			))
+	`, cutoff)
+	if err != nil {
+		return fmt.Errorf("can't purge compacted transactions: %w", err)
+	}
+
+	return nil
+}
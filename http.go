@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HTTPServer exposes Server's account operations over HTTP/JSON.
+type HTTPServer struct {
+	server     *Server
+	httpServer *http.Server
+}
+
+// NewHTTPServer wires up the routes and returns an HTTPServer listening on addr once Run is called.
+func NewHTTPServer(server *Server, addr string) *HTTPServer {
+	h := &HTTPServer{server: server}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /accounts/{id}/deposit", h.handleDeposit)
+	mux.HandleFunc("POST /accounts/{id}/withdraw", h.handleWithdraw)
+	mux.HandleFunc("POST /transfers", h.handleTransfer)
+	mux.HandleFunc("GET /accounts/{id}/balance", h.handleBalance)
+
+	h.httpServer = &http.Server{Addr: addr, Handler: mux}
+	return h
+}
+
+// Run starts serving requests and blocks until the server is shut down.
+func (h *HTTPServer) Run() error {
+	if err := h.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("can't run http server: %w", err)
+	}
+	return nil
+}
+
+// Shutdown drains inflight requests and then closes the underlying DB connection.
+func (h *HTTPServer) Shutdown(ctx context.Context) error {
+	if err := h.httpServer.Shutdown(ctx); err != nil {
+		return fmt.Errorf("can't shutdown http server: %w", err)
+	}
+	return h.server.db.Close()
+}
+
+type depositRequest struct {
+	Amount int64 `json:"amount"`
+}
+
+type transferRequest struct {
+	From   UserId `json:"from"`
+	To     UserId `json:"to"`
+	Amount int64  `json:"amount"`
+}
+
+type balanceResponse struct {
+	Balance int64 `json:"balance"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func (h *HTTPServer) handleDeposit(w http.ResponseWriter, r *http.Request) {
+	userId, err := parseUserId(r.PathValue("id"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+
+	var req depositRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("can't decode body: %s", err)})
+		return
+	}
+
+	status, body, err := h.withIdempotency(r.Context(), r.Header.Get("Idempotency-Key"), func() (int, any) {
+		if err := h.server.add(r.Context(), userId, req.Amount); err != nil {
+			return errorStatus(err), errorResponse{Error: err.Error()}
+		}
+		return http.StatusOK, struct{}{}
+	})
+	if err != nil {
+		writeJSON(w, errorStatus(err), errorResponse{Error: err.Error()})
+		return
+	}
+	writeRaw(w, status, body)
+}
+
+func (h *HTTPServer) handleWithdraw(w http.ResponseWriter, r *http.Request) {
+	userId, err := parseUserId(r.PathValue("id"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+
+	var req depositRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("can't decode body: %s", err)})
+		return
+	}
+
+	status, body, err := h.withIdempotency(r.Context(), r.Header.Get("Idempotency-Key"), func() (int, any) {
+		if err := h.server.withdraw(r.Context(), userId, req.Amount); err != nil {
+			return errorStatus(err), errorResponse{Error: err.Error()}
+		}
+		return http.StatusOK, struct{}{}
+	})
+	if err != nil {
+		writeJSON(w, errorStatus(err), errorResponse{Error: err.Error()})
+		return
+	}
+	writeRaw(w, status, body)
+}
+
+func (h *HTTPServer) handleTransfer(w http.ResponseWriter, r *http.Request) {
+	var req transferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("can't decode body: %s", err)})
+		return
+	}
+
+	status, body, err := h.withIdempotency(r.Context(), r.Header.Get("Idempotency-Key"), func() (int, any) {
+		if err := h.server.transfer(r.Context(), req.From, req.To, req.Amount); err != nil {
+			return errorStatus(err), errorResponse{Error: err.Error()}
+		}
+		return http.StatusOK, struct{}{}
+	})
+	if err != nil {
+		writeJSON(w, errorStatus(err), errorResponse{Error: err.Error()})
+		return
+	}
+	writeRaw(w, status, body)
+}
+
+func (h *HTTPServer) handleBalance(w http.ResponseWriter, r *http.Request) {
+	userId, err := parseUserId(r.PathValue("id"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+
+	balance, err := h.server.balance(r.Context(), userId)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, balanceResponse{Balance: balance})
+}
+
+// requestLogEntry mirrors a row of the request_log table. response_body is nil while a request
+// is still being claimed/in flight, and is only set once the claimant has a result to store.
+type requestLogEntry struct {
+	StatusCode   int    `db:"status_code"`
+	ResponseBody []byte `db:"response_body"`
+}
+
+// idempotencyPollInterval is how often a request that lost the claim on an Idempotency-Key
+// re-checks request_log for the winner's result.
+const idempotencyPollInterval = 25 * time.Millisecond
+
+// idempotencyClaimTTL bounds how long a claim row may sit with a NULL response_body before
+// awaitIdempotentResult treats its claimant as dead and fails with errAbandonedIdempotencyClaim
+// instead of waiting on. Without this,
+// a winner that crashed (or whose persist below failed) between claiming the key and filling in
+// response_body would wedge every other caller using that key until their ctx expired.
+const idempotencyClaimTTL = 30 * time.Second
+
+// withIdempotency persists the result of fn under key in request_log, so that a retried call with
+// the same Idempotency-Key header returns the original response instead of running fn again. A
+// missing key disables idempotency and fn always runs.
+//
+// The key is claimed with an INSERT ... ON CONFLICT DO NOTHING before fn runs, so that of two
+// concurrent callers racing on the same key, only the one that wins the insert executes fn; the
+// loser waits for the winner to fill in response_body instead of running fn itself.
+//
+// 2xx and 4xx results are both final, deterministic outcomes of this request — a balance check
+// that fails once fails the same way every time — so both are persisted under the key and a
+// retry never re-runs fn for them. Only a 5xx is treated as transient (DB error, a serialization
+// failure that escaped withTx's retries, ...) and releases the claim instead of recording it, so
+// a retry gets a fresh attempt.
+func (h *HTTPServer) withIdempotency(ctx context.Context, key string, fn func() (int, any)) (int, []byte, error) {
+	if key == "" {
+		status, resp := fn()
+		return status, mustMarshal(resp), nil
+	}
+
+	claimed, err := h.claimIdempotencyKey(ctx, key)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !claimed {
+		return h.awaitIdempotentResult(ctx, key)
+	}
+
+	return h.runClaimed(ctx, key, fn)
+}
+
+// runClaimed runs fn for the caller that holds key's claim and either persists its result or
+// releases the claim, per the rule documented on withIdempotency.
+func (h *HTTPServer) runClaimed(ctx context.Context, key string, fn func() (int, any)) (int, []byte, error) {
+	status, resp := fn()
+	body := mustMarshal(resp)
+
+	if status >= 500 {
+		if _, err := h.server.db.ExecContext(ctx, `DELETE FROM request_log WHERE idempotency_key = $1`, key); err != nil {
+			return 0, nil, fmt.Errorf("can't release idempotency key after a failed request: %w", err)
+		}
+		return status, body, nil
+	}
+
+	if _, err := h.server.db.ExecContext(ctx, `
+		UPDATE request_log SET status_code = $2, response_body = $3 WHERE idempotency_key = $1
+	`, key, status, body); err != nil {
+		return 0, nil, fmt.Errorf("can't persist idempotency key: %w", err)
+	}
+
+	return status, body, nil
+}
+
+// claimIdempotencyKey tries to insert the placeholder row for key, reporting whether this call
+// won the claim (response_body starts out NULL and is filled in by the winner once fn returns).
+func (h *HTTPServer) claimIdempotencyKey(ctx context.Context, key string) (bool, error) {
+	var claimed string
+	err := h.server.db.GetContext(ctx, &claimed, `
+		INSERT INTO request_log (idempotency_key, status_code, response_body, created_at)
+			VALUES ($1, 0, NULL, NOW())
+		ON CONFLICT (idempotency_key) DO NOTHING
+		RETURNING idempotency_key
+	`, key)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return false, fmt.Errorf("can't claim idempotency key: %w", err)
+}
+
+// errAbandonedIdempotencyClaim is returned when a claim has sat with no response_body for longer
+// than idempotencyClaimTTL. Whether its claimant's fn actually ran and committed before the
+// claimant died (or before its persist in runClaimed failed) is unknowable from here: fn's own
+// transaction and the request_log write are separate transactions, so a crash between them is
+// indistinguishable from a crash before fn ran at all. Handing the key to a new caller to retry,
+// as an earlier version of this code did, therefore risked silently running a money-moving fn a
+// second time. Surfacing an error instead forces whoever holds this Idempotency-Key to stop and
+// investigate (e.g. check whether the transaction it expected already exists) rather than having
+// the client silently double-apply it.
+var errAbandonedIdempotencyClaim = errors.New("idempotency key's prior attempt result is unknown and must not be retried automatically")
+
+// awaitIdempotentResult polls request_log until the caller that claimed key has filled in its
+// result, ctx is done, or the claim looks abandoned.
+func (h *HTTPServer) awaitIdempotentResult(ctx context.Context, key string) (int, []byte, error) {
+	for {
+		var entry requestLogEntry
+		err := h.server.db.GetContext(ctx, &entry, `
+			SELECT status_code, response_body FROM request_log
+				WHERE idempotency_key = $1 AND response_body IS NOT NULL
+		`, key)
+		if err == nil {
+			return entry.StatusCode, entry.ResponseBody, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return 0, nil, fmt.Errorf("can't look up idempotency key: %w", err)
+		}
+
+		abandoned, err := h.isIdempotencyClaimAbandoned(ctx, key)
+		if err != nil {
+			return 0, nil, err
+		}
+		if abandoned {
+			return 0, nil, errAbandonedIdempotencyClaim
+		}
+
+		select {
+		case <-time.After(idempotencyPollInterval):
+		case <-ctx.Done():
+			return 0, nil, ctx.Err()
+		}
+	}
+}
+
+// isIdempotencyClaimAbandoned reports whether key's claim row has sat with no response_body for
+// longer than idempotencyClaimTTL. It does not touch the row: see errAbandonedIdempotencyClaim
+// for why this must not be taken as license to run fn again.
+func (h *HTTPServer) isIdempotencyClaimAbandoned(ctx context.Context, key string) (bool, error) {
+	var abandoned bool
+	err := h.server.db.GetContext(ctx, &abandoned, `
+		SELECT EXISTS (
+			SELECT 1 FROM request_log
+				WHERE idempotency_key = $1 AND response_body IS NULL AND created_at < $2
+		)
+	`, key, time.Now().Add(-idempotencyClaimTTL))
+	if err != nil {
+		return false, fmt.Errorf("can't check for an abandoned idempotency claim: %w", err)
+	}
+	return abandoned, nil
+}
+
+// errorStatus maps an error from Server's business logic, or from withIdempotency itself, to the
+// HTTP status it should be surfaced as. Deterministic business rejections get a 4xx, which is
+// both the accurate status for the client and, via withIdempotency's 4xx/5xx split, what makes
+// them safe to cache and replay instead of re-running fn on every retry.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errInsufficientFunds):
+		return http.StatusConflict
+	case errors.Is(err, errAbandonedIdempotencyClaim):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func parseUserId(raw string) (UserId, error) {
+	id, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid account id %q: %w", raw, err)
+	}
+	return UserId(id), nil
+}
+
+func mustMarshal(v any) []byte {
+	body, err := json.Marshal(v)
+	if err != nil {
+		panic(fmt.Sprintf("can't marshal response: %s", err))
+	}
+	return body
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	writeRaw(w, status, mustMarshal(v))
+}
+
+func writeRaw(w http.ResponseWriter, status int, body []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -5,8 +5,16 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 type UserId int64
@@ -28,162 +36,255 @@ const (
 	dbname   = "bank"
 )
 
+const (
+	compactionInterval  = time.Minute
+	compactionThreshold = 1000
+)
+
+// defaultMaxTxAttempts is how many times in all withTx runs a transaction that keeps hitting a
+// serialization failure or deadlock (the first try included), unless a Server overrides it via
+// maxTxAttempts.
+const defaultMaxTxAttempts = 5
+
 type Server struct {
 	db *sqlx.DB
+	// maxTxAttempts bounds how many times in all withTx runs fn, the first try included, when it
+	// keeps failing with a retriable SQLSTATE. Zero means defaultMaxTxAttempts.
+	maxTxAttempts int
 }
 
 func NewServer(db *sqlx.DB) *Server {
-	return &Server{db: db}
+	return &Server{db: db, maxTxAttempts: defaultMaxTxAttempts}
 }
 
-func main() {
-	db, err := sqlx.Connect(
-		"postgres",
-		fmt.Sprintf("port=%d user=%s password=%s dbname=%s sslmode=disable", port, username, password, dbname))
-	if err != nil {
-		fmt.Printf("err %s", err)
+// withTx begins a transaction at isolation level iso, runs fn, and commits. A deferred rollback
+// makes this safe regardless of how fn returns: it's a no-op once the transaction has committed
+// and otherwise undoes every statement fn ran, which is what add/withdraw/transfer/balance used
+// to get wrong by committing or skipping Rollback on some of their error paths.
+//
+// If the driver reports a serialization failure (SQLSTATE 40001) or a deadlock (40P01), fn's
+// snapshot is no longer valid, so withTx retries the whole closure from scratch with jittered
+// exponential backoff, for at most maxTxAttempts attempts in all, bounded by ctx.
+func (s *Server) withTx(ctx context.Context, iso sql.IsolationLevel, fn func(*sqlx.Tx) error) error {
+	maxAttempts := s.maxTxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxTxAttempts
 	}
 
-	ctx := context.Background()
-
-	server := NewServer(db)
-	server.add(ctx, UserId(1), 40)
-	balance, _ := server.balance(ctx, UserId(1))
-	fmt.Println("balance user 1: ", balance)
-	server.transfer(ctx, UserId(1), UserId(2), 30)
-	balance, _ = server.balance(ctx, UserId(2))
-	fmt.Println("balance user 2: ", balance)
-}
-
-// add Зачисляет средства на счет пользователя. Добавляет в таблицу транзакций строку "пользователь id получил amount копеек"
-func (s *Server) add(ctx context.Context, userId UserId, amount int64) error {
-	tx, err := s.db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
-	if err != nil {
-		return fmt.Errorf("can't start transaction: %w", err)
-	}
-	rows, err := tx.QueryxContext(ctx, `
-		INSERT INTO transactions (id, user_from, user_to, amount, created_at)
-			VALUES (gen_random_uuid(), null, $1, $2, NOW());
-	`, userId, amount)
-	if err != nil {
-		tx.Rollback() // тут и далее везде в обработке ошибок нужно сделать rollback транзакции и обработать ошибку от этой функции
-		return fmt.Errorf("can't run query: %w", err)
-	}
-	rows.Close() // и обработать все ошибки во всех функциях
-	err = tx.Commit()
-	if err != nil {
-		return fmt.Errorf("can't commit transaction: %w", err)
+	var err error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			backoff := time.Duration(1<<uint(attempt)) * 10 * time.Millisecond
+			jitter := time.Duration(rand.Int63n(int64(backoff)))
+			select {
+			case <-time.After(backoff + jitter):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		err = s.withTxOnce(ctx, iso, fn)
+		if err == nil || !isRetriableTxErr(err) {
+			return err
+		}
 	}
 
-	return nil
+	return err
 }
 
-// withdraw Списывает средства со счета пользователя. Вычисляет баланс пользователя, добавляет/обновляет строку в таблице accounts:
-// "у пользователя id посчитан баланс для последней транзакции transactionNum, он составляет столько-то копеек".
-// (см. описание функции вычисления баланса)
-// Если баланс пользователя выше, чем amount, то добавляем строку в таблицу transactions
-// "у пользователя id списано amount копеек"
-func (s *Server) withdraw(ctx context.Context, userId UserId, amount int64) error {
-	tx, err := s.db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+func (s *Server) withTxOnce(ctx context.Context, iso sql.IsolationLevel, fn func(*sqlx.Tx) error) error {
+	tx, err := s.db.BeginTxx(ctx, &sql.TxOptions{Isolation: iso})
 	if err != nil {
 		return fmt.Errorf("can't start transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	balance, transactionNum, err := getBalance(ctx, tx, userId)
-	if err != nil {
-		return fmt.Errorf("can't get balance: %w", err)
-	}
-	err = updateBalance(ctx, userId, balance, transactionNum, tx)
-	if err != nil {
-		return fmt.Errorf("can't update balance: %w", err)
-	}
-	if balance < amount {
-		tx.Commit()
-		return errors.New("balance < amount")
-	}
-
-	rows, err := tx.QueryxContext(ctx, `
-		INSERT INTO transactions (id, user_from, user_to, amount, created_at)
-			VALUES (gen_random_uuid(), $1, null, $2, NOW());
-	`, userId, amount)
-	if err != nil {
-		return fmt.Errorf("can't run query: %w", err)
+	if err := fn(tx); err != nil {
+		return err
 	}
-	rows.Close()
 
-	err = tx.Commit()
-	if err != nil {
+	if err := tx.Commit(); err != nil {
 		return fmt.Errorf("can't commit transaction: %w", err)
 	}
 
 	return nil
 }
 
-// transfer Переводит средства со счета пользователя fromId на счет пользователя toId. Перед списанием проверяет и обновляет баланс в таблице accounts у пользователя fromId.
-func (s *Server) transfer(ctx context.Context, fromId UserId, toId UserId, amount int64) error {
-	tx, err := s.db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
-	if err != nil {
-		return fmt.Errorf("can't start transaction: %w", err)
+// isRetriableTxErr reports whether err is a Postgres deadlock (40P01) or serialization failure
+// (40001), the two SQLSTATEs that mean the transaction's snapshot was invalidated and the whole
+// closure must be re-run, not just resumed.
+func isRetriableTxErr(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
 	}
+	return pqErr.Code == "40001" || pqErr.Code == "40P01"
+}
 
-	balance, transactionNum, err := getBalance(ctx, tx, fromId)
-	if err != nil {
-		return fmt.Errorf("can't get balance: %w", err)
-	}
-	err = updateBalance(ctx, fromId, balance, transactionNum, tx)
+func main() {
+	db, err := sqlx.Connect(
+		"postgres",
+		fmt.Sprintf("port=%d user=%s password=%s dbname=%s sslmode=disable", port, username, password, dbname))
 	if err != nil {
-		return fmt.Errorf("can't update balance: %w", err)
-	}
-	if balance < amount {
-		err = tx.Commit()
-		return errors.New("balance < amount")
+		fmt.Printf("err %s", err)
 	}
 
-	rows, err := tx.QueryxContext(ctx, `
-		INSERT INTO transactions (id, user_from, user_to, amount, created_at)
-			VALUES (gen_random_uuid(), $1, $2, $3, NOW())
-	`, fromId, toId, amount)
-	if err != nil {
-		err = tx.Rollback()
+	server := NewServer(db)
+	httpServer := NewHTTPServer(server, ":8080")
 
-		return fmt.Errorf("can't run query: %w", err)
-	}
-	rows.Close()
+	go func() {
+		if err := httpServer.Run(); err != nil {
+			log.Fatalf("http server stopped: %s", err)
+		}
+	}()
 
-	err = tx.Commit()
-	if err != nil {
-		return fmt.Errorf("can't commit transaction: %w", err)
-	}
+	compactor := NewCompactor(server, compactionInterval, compactionThreshold)
+	compactorCtx, stopCompactor := context.WithCancel(context.Background())
+	go compactor.Run(compactorCtx)
 
-	return nil
-}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
 
-// balance Вычисляет баланс у пользователя id и обновляет его в таблице accounts.
-func (s *Server) balance(ctx context.Context, userId UserId) (int64, error) {
-	tx, err := s.db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
-	if err != nil {
-		return 0, fmt.Errorf("can't start transaction: %w", err)
-	}
+	stopCompactor()
 
-	balance, transactionNum, err := getBalance(ctx, tx, userId)
-	if err != nil {
-		err = tx.Rollback()
-		return 0, fmt.Errorf("can't get balance: %w", err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Printf("error during shutdown: %s", err)
 	}
+}
 
-	err = updateBalance(ctx, userId, balance, transactionNum, tx)
+// Transaction status values. Rows are inserted pending, then transitioned to completed or
+// failed inside the same DB transaction. A completed row can later become cancelled, but only
+// via Cancel, not Reverse: Reverse leaves the original completed and undoes it with a
+// compensating entry instead, for the reason documented on Reverse.
+const (
+	statusPending   = "pending"
+	statusCompleted = "completed"
+	statusCancelled = "cancelled"
+	statusFailed    = "failed"
+)
+
+// errInsufficientFunds is returned by withdraw/transfer when the debited account's balance is
+// below the requested amount. It's a final, deterministic business rejection rather than an
+// infrastructure failure, so callers (see http.go's errorStatus) should surface it as a 4xx and
+// treat it as safe to cache under an Idempotency-Key, not something worth retrying as-is.
+var errInsufficientFunds = errors.New("balance < amount")
+
+// add Зачисляет средства на счет пользователя. Добавляет в таблицу транзакций строку "пользователь id получил amount копеек"
+func (s *Server) add(ctx context.Context, userId UserId, amount int64) error {
+	return s.withTx(ctx, sql.LevelRepeatableRead, func(tx *sqlx.Tx) error {
+		var txID uuid.UUID
+		err := tx.QueryRowxContext(ctx, `
+			INSERT INTO transactions (id, user_from, user_to, amount, status, created_at)
+				VALUES (gen_random_uuid(), null, $1, $2, $3, NOW())
+			RETURNING id
+		`, userId, amount, statusPending).Scan(&txID)
+		if err != nil {
+			return fmt.Errorf("can't run query: %w", err)
+		}
+		return setTransactionStatus(ctx, tx, txID, statusCompleted)
+	})
+}
+
+// withdraw Списывает средства со счета пользователя. Вычисляет баланс пользователя, добавляет/обновляет строку в таблице accounts:
+// "у пользователя id посчитан баланс для последней транзакции transactionNum, он составляет столько-то копеек".
+// (см. описание функции вычисления баланса)
+// Затем добавляет в таблицу transactions строку "у пользователя id списано amount копеек" в статусе pending:
+// если баланс не меньше amount, строка переводится в completed, иначе в failed, и возвращается errInsufficientFunds.
+func (s *Server) withdraw(ctx context.Context, userId UserId, amount int64) error {
+	var insufficientFunds error
+	err := s.withTx(ctx, sql.LevelRepeatableRead, func(tx *sqlx.Tx) error {
+		// Reset on every attempt: withTx re-runs fn from scratch on a retriable error, and a
+		// value set on a prior attempt must not leak into one that completes successfully.
+		insufficientFunds = nil
+
+		balance, transactionNum, err := getBalance(ctx, tx, userId)
+		if err != nil {
+			return fmt.Errorf("can't get balance: %w", err)
+		}
+		if err := updateBalance(ctx, userId, balance, transactionNum, tx); err != nil {
+			return fmt.Errorf("can't update balance: %w", err)
+		}
+
+		var txID uuid.UUID
+		err = tx.QueryRowxContext(ctx, `
+			INSERT INTO transactions (id, user_from, user_to, amount, status, created_at)
+				VALUES (gen_random_uuid(), $1, null, $2, $3, NOW())
+			RETURNING id
+		`, userId, amount, statusPending).Scan(&txID)
+		if err != nil {
+			return fmt.Errorf("can't run query: %w", err)
+		}
+
+		if balance < amount {
+			insufficientFunds = errInsufficientFunds
+			return setTransactionStatus(ctx, tx, txID, statusFailed)
+		}
+
+		return setTransactionStatus(ctx, tx, txID, statusCompleted)
+	})
 	if err != nil {
-		err = tx.Rollback()
-		return 0, err
-		// ...
+		return err
 	}
+	return insufficientFunds
+}
 
-	err = tx.Commit()
+// transfer Переводит средства со счета пользователя fromId на счет пользователя toId. Перед списанием проверяет и обновляет баланс в таблице accounts у пользователя fromId.
+func (s *Server) transfer(ctx context.Context, fromId UserId, toId UserId, amount int64) error {
+	var insufficientFunds error
+	err := s.withTx(ctx, sql.LevelRepeatableRead, func(tx *sqlx.Tx) error {
+		// Reset on every attempt: withTx re-runs fn from scratch on a retriable error, and a
+		// value set on a prior attempt must not leak into one that completes successfully.
+		insufficientFunds = nil
+
+		balance, transactionNum, err := getBalance(ctx, tx, fromId)
+		if err != nil {
+			return fmt.Errorf("can't get balance: %w", err)
+		}
+		if err := updateBalance(ctx, fromId, balance, transactionNum, tx); err != nil {
+			return fmt.Errorf("can't update balance: %w", err)
+		}
+
+		var txID uuid.UUID
+		err = tx.QueryRowxContext(ctx, `
+			INSERT INTO transactions (id, user_from, user_to, amount, status, created_at)
+				VALUES (gen_random_uuid(), $1, $2, $3, $4, NOW())
+			RETURNING id
+		`, fromId, toId, amount, statusPending).Scan(&txID)
+		if err != nil {
+			return fmt.Errorf("can't run query: %w", err)
+		}
+
+		if balance < amount {
+			insufficientFunds = errInsufficientFunds
+			return setTransactionStatus(ctx, tx, txID, statusFailed)
+		}
+
+		return setTransactionStatus(ctx, tx, txID, statusCompleted)
+	})
 	if err != nil {
-		return 0, fmt.Errorf("can't commit transaction: %w", err)
+		return err
 	}
+	return insufficientFunds
+}
 
-	return balance, nil
+// balance Вычисляет баланс у пользователя id и обновляет его в таблице accounts.
+func (s *Server) balance(ctx context.Context, userId UserId) (int64, error) {
+	var balance int64
+	err := s.withTx(ctx, sql.LevelRepeatableRead, func(tx *sqlx.Tx) error {
+		b, transactionNum, err := getBalance(ctx, tx, userId)
+		if err != nil {
+			return fmt.Errorf("can't get balance: %w", err)
+		}
+		if err := updateBalance(ctx, userId, b, transactionNum, tx); err != nil {
+			return err
+		}
+		balance = b
+		return nil
+	})
+	return balance, err
 }
 
 // getBalance Берет из таблицы accounts последниий вычисленный баланс вместе с последним номером транзакции, для которой он был вычислен
@@ -204,11 +305,11 @@ func getBalance(ctx context.Context, tx *sqlx.Tx, userId UserId) (balance int64,
 
 	rowsTransactionsBalance := tx.QueryRowxContext(ctx, `
 		SELECT COALESCE(SUM(s), 0) balance, COALESCE(MAX(tn), $2) transaction_num FROM (
-			SELECT SUM(amount) s, MAX(transaction_num) tn FROM transactions 
-				WHERE user_to = $1 AND transaction_num > $2
+			SELECT SUM(amount) s, MAX(transaction_num) tn FROM transactions
+				WHERE user_to = $1 AND transaction_num > $2 AND status = 'completed'
 			UNION
 			SELECT -1*SUM(amount) s, MAX(transaction_num) tn FROM transactions
-				WHERE user_from = $1 AND transaction_num > $2
+				WHERE user_from = $1 AND transaction_num > $2 AND status = 'completed'
 		) sums
 	`, userId, accountBalance.TransactionNum)
 	transactionBalance := &RawTransactionBalance{}
@@ -238,3 +339,16 @@ func updateBalance(ctx context.Context, userId UserId, balance int64, transactio
 
 	return nil
 }
+
+// setTransactionStatus transitions a transactions row to status. It is how add/withdraw/transfer
+// move a freshly inserted pending row to completed or failed, how Reverse and TransferBatch
+// complete the rows they insert, and how Cancel moves an already-completed row to cancelled.
+// Reverse itself does not cancel the original transaction; see Reverse's doc comment for why
+// that row is deliberately left completed instead.
+func setTransactionStatus(ctx context.Context, tx *sqlx.Tx, txID uuid.UUID, status string) error {
+	rows, err := tx.QueryxContext(ctx, `UPDATE transactions SET status = $2 WHERE id = $1`, txID, status)
+	if err != nil {
+		return fmt.Errorf("can't update transaction status: %w", err)
+	}
+	return rows.Close()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+// originalTransaction is the subset of a transactions row Reverse and Cancel need: enough to
+// build a compensating entry, or to tell whether the row is still safe to cancel outright.
+type originalTransaction struct {
+	UserFrom       sql.NullInt64 `db:"user_from"`
+	UserTo         sql.NullInt64 `db:"user_to"`
+	Amount         int64         `db:"amount"`
+	Status         string        `db:"status"`
+	TransactionNum int64         `db:"transaction_num"`
+}
+
+// Reverse undoes a completed transaction without hand-editing the ledger: it inserts a
+// compensating transaction with user_from/user_to swapped relative to the original (so a
+// reversed deposit becomes a withdrawal and vice versa, and a reversed transfer runs the other
+// way) and links it back via reverses_transaction_id.
+//
+// The original row is left completed rather than moved to cancelled: getBalance's SUM aggregates
+// only count completed rows, so cancelling the original would drop its contribution the moment
+// it is reversed, while the compensating entry adds the opposite leg on top — netting to double
+// the amount instead of zero, unless the original had already been folded into the accounts
+// snapshot by the Compactor. Double-reversal is blocked explicitly instead, by checking whether
+// a completed transaction already points back at txID via reverses_transaction_id.
+//
+// Reverse is the general-purpose undo: it works no matter how old the original transaction is.
+// Cancel is the narrower operation that actually sets status to cancelled, for the case where
+// that's still safe to do.
+func (s *Server) Reverse(ctx context.Context, txID uuid.UUID, reason string) error {
+	return s.withTx(ctx, sql.LevelRepeatableRead, func(tx *sqlx.Tx) error {
+		var original originalTransaction
+		err := tx.QueryRowxContext(ctx, `
+			SELECT user_from, user_to, amount, status, transaction_num FROM transactions WHERE id = $1 FOR UPDATE
+		`, txID).StructScan(&original)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("transaction %s not found", txID)
+			}
+			return fmt.Errorf("can't look up transaction %s: %w", txID, err)
+		}
+		if original.Status != statusCompleted {
+			return fmt.Errorf("can't reverse transaction %s in status %q", txID, original.Status)
+		}
+
+		var alreadyReversed bool
+		err = tx.QueryRowxContext(ctx, `
+			SELECT EXISTS (SELECT 1 FROM transactions WHERE reverses_transaction_id = $1 AND status = $2)
+		`, txID, statusCompleted).Scan(&alreadyReversed)
+		if err != nil {
+			return fmt.Errorf("can't check for an existing reversal of %s: %w", txID, err)
+		}
+		if alreadyReversed {
+			return fmt.Errorf("transaction %s has already been reversed", txID)
+		}
+
+		var reverseFrom, reverseTo *int64
+		if original.UserTo.Valid {
+			reverseFrom = &original.UserTo.Int64
+		}
+		if original.UserFrom.Valid {
+			reverseTo = &original.UserFrom.Int64
+		}
+
+		var reverseTxID uuid.UUID
+		err = tx.QueryRowxContext(ctx, `
+			INSERT INTO transactions (id, user_from, user_to, amount, status, reason, created_at, reverses_transaction_id)
+				VALUES (gen_random_uuid(), $1, $2, $3, $4, $5, NOW(), $6)
+			RETURNING id
+		`, reverseFrom, reverseTo, original.Amount, statusPending, reason, txID).Scan(&reverseTxID)
+		if err != nil {
+			return fmt.Errorf("can't run query: %w", err)
+		}
+
+		return setTransactionStatus(ctx, tx, reverseTxID, statusCompleted)
+	})
+}
+
+// Cancel marks a completed transaction cancelled outright, with no compensating entry. This is
+// only safe while every account the transaction touched has not yet folded it into its accounts
+// snapshot: getBalance only re-sums transactions with transaction_num greater than the snapshot's,
+// so once the Compactor (or a lazy updateBalance) has advanced a user's snapshot past this
+// transaction's own transaction_num, un-completing it here would no longer change any future
+// balance read for that user — the cancellation would be silently lost. Reverse is the only way
+// to undo a transaction past that point; Cancel reports an error telling the caller to use it
+// instead of quietly doing the wrong thing.
+func (s *Server) Cancel(ctx context.Context, txID uuid.UUID, reason string) error {
+	return s.withTx(ctx, sql.LevelRepeatableRead, func(tx *sqlx.Tx) error {
+		var original originalTransaction
+		err := tx.QueryRowxContext(ctx, `
+			SELECT user_from, user_to, amount, status, transaction_num FROM transactions WHERE id = $1 FOR UPDATE
+		`, txID).StructScan(&original)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("transaction %s not found", txID)
+			}
+			return fmt.Errorf("can't look up transaction %s: %w", txID, err)
+		}
+		if original.Status != statusCompleted {
+			return fmt.Errorf("can't cancel transaction %s in status %q", txID, original.Status)
+		}
+
+		for _, userId := range implicatedUsers(original) {
+			snapshotted, err := snapshottedTransactionNum(ctx, tx, userId)
+			if err != nil {
+				return fmt.Errorf("can't check user %d's balance snapshot: %w", userId, err)
+			}
+			if original.TransactionNum <= snapshotted {
+				return fmt.Errorf(
+					"transaction %s is already folded into user %d's balance snapshot; use Reverse instead",
+					txID, userId)
+			}
+		}
+
+		// reason isn't persisted: Cancel, unlike Reverse, doesn't insert a row for it to live on.
+		// Taking the parameter keeps the signature symmetric with Reverse for callers that decide
+		// between the two at the last moment.
+		return setTransactionStatus(ctx, tx, txID, statusCancelled)
+	})
+}
+
+// implicatedUsers returns the accounts original's status affects: user_from, user_to, or both.
+func implicatedUsers(original originalTransaction) []UserId {
+	var users []UserId
+	if original.UserFrom.Valid {
+		users = append(users, UserId(original.UserFrom.Int64))
+	}
+	if original.UserTo.Valid {
+		users = append(users, UserId(original.UserTo.Int64))
+	}
+	return users
+}
+
+// snapshottedTransactionNum returns the transaction_num already folded into userId's accounts
+// snapshot, or 0 if userId has no snapshot row yet (meaning nothing has been folded in at all).
+func snapshottedTransactionNum(ctx context.Context, tx *sqlx.Tx, userId UserId) (int64, error) {
+	var transactionNum int64
+	err := tx.QueryRowxContext(ctx, `SELECT transaction_num FROM accounts WHERE user_id = $1`, userId).Scan(&transactionNum)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+	return transactionNum, nil
+}